@@ -0,0 +1,276 @@
+package tiered
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	ds "github.com/jbenet/go-datastore"
+	dsq "github.com/jbenet/go-datastore/query"
+)
+
+// PruneOptions configures a mark-and-sweep GC pass over the coldest tier.
+type PruneOptions struct {
+	// Expand enumerates the keys a value references, so the walk can
+	// follow them. Required.
+	Expand func(value interface{}) []ds.Key
+	// LiveSetSize estimates the number of reachable keys, used to size
+	// the mark filter. Ignored when Exact is set.
+	LiveSetSize uint64
+	// HashCount is the number of hash functions the mark filter uses.
+	// Defaults to 3, as in Lotus's chain-pruning bloom.
+	HashCount int
+	// Exact swaps the bloom-backed mark filter for a plain set, which
+	// has no false positives at the cost of memory proportional to the
+	// live set. Use it for small datasets where mistakenly keeping a
+	// dead key matters more than the memory.
+	Exact bool
+	// DryRun only counts what would be swept; it deletes or archives
+	// nothing.
+	DryRun bool
+	// MoveToColderTier demotes unreachable entries into ArchiveTo instead
+	// of deleting them from the target tier. ArchiveTo must be set.
+	MoveToColderTier bool
+	// ArchiveTo is the archival datastore entries are moved into when
+	// MoveToColderTier is set.
+	ArchiveTo ds.Datastore
+}
+
+// PruneStats summarizes a Prune pass.
+type PruneStats struct {
+	// Visited is the number of keys the target tier held.
+	Visited int
+	// Swept is the number of keys deleted (or, in DryRun, that would
+	// have been).
+	Swept int
+	// Archived is the number of swept keys moved to ArchiveTo rather
+	// than deleted.
+	Archived int
+	// DryRun mirrors the option the pass ran with.
+	DryRun bool
+}
+
+// markSet answers reachability queries for the keys visited during a
+// Prune walk.
+type markSet interface {
+	mark(key ds.Key)
+	has(key ds.Key) bool
+}
+
+// mapSet is the exact markSet fallback for PruneOptions.Exact.
+type mapSet map[ds.Key]struct{}
+
+func (s mapSet) mark(key ds.Key)     { s[key] = struct{}{} }
+func (s mapSet) has(key ds.Key) bool { _, ok := s[key]; return ok }
+
+// markBloom is a small, self-contained counting-free bloom filter sized
+// for a single Prune pass, using double hashing (Kirsch-Mitzenmacher) to
+// derive HashCount independent bit positions per key from two fnv-64a
+// hashes. It exists separately from the bbloom-backed negative cache in
+// tiered.go because GC wants a filter sized to the live set for one pass,
+// not a long-lived per-tier cache.
+type markBloom struct {
+	bits    []uint64
+	numBits uint64
+	hashes  int
+}
+
+func newMarkBloom(liveSetSize uint64, hashes int) *markBloom {
+	if hashes <= 0 {
+		hashes = 3
+	}
+	numBits := liveSetSize * 8 // ~8 bits/entry keeps the false-positive rate low for hashes=3
+	if numBits == 0 {
+		numBits = 64
+	}
+	return &markBloom{
+		bits:    make([]uint64, (numBits+63)/64),
+		numBits: numBits,
+		hashes:  hashes,
+	}
+}
+
+func (b *markBloom) positions(key ds.Key) []uint64 {
+	data := []byte(key.String())
+	h1 := fnvSum(data, 0)
+	h2 := fnvSum(data, 1)
+	pos := make([]uint64, b.hashes)
+	for i := 0; i < b.hashes; i++ {
+		pos[i] = (h1 + uint64(i)*h2) % b.numBits
+	}
+	return pos
+}
+
+func fnvSum(data []byte, seed byte) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{seed})
+	h.Write(data)
+	return h.Sum64()
+}
+
+func (b *markBloom) mark(key ds.Key) {
+	for _, p := range b.positions(key) {
+		b.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (b *markBloom) has(key ds.Key) bool {
+	for _, p := range b.positions(key) {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// putObserver is notified of every key Put through the tiered datastore,
+// regardless of mode. Prune subscribes one for the duration of its walk
+// so that a concurrent Put can't be swept out from under it: the walk
+// may not have reached a key yet when it's written, but a live write is
+// reachable by definition.
+type putObserver func(key ds.Key)
+
+func (d *tiered) observePuts(fn putObserver) (unsubscribe func()) {
+	d.observersMu.Lock()
+	defer d.observersMu.Unlock()
+	if d.observers == nil {
+		d.observers = make(map[int]putObserver)
+	}
+	id := d.nextObserverID
+	d.nextObserverID++
+	d.observers[id] = fn
+	return func() {
+		d.observersMu.Lock()
+		defer d.observersMu.Unlock()
+		delete(d.observers, id)
+	}
+}
+
+func (d *tiered) notifyPut(key ds.Key) {
+	d.observersMu.Lock()
+	defer d.observersMu.Unlock()
+	for _, fn := range d.observers {
+		fn(key)
+	}
+}
+
+// coldTier returns the first tier tagged Role Cold. Prune targets it by role,
+// not by position, since TierOptions.Role lets a caller assign Cold to
+// any index.
+func (d *tiered) coldTier() (*tier, error) {
+	for _, t := range d.tiers {
+		if t.role == Cold {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("tiered: no tier has Role Cold; Prune needs one")
+}
+
+// Prune runs a mark-and-sweep GC pass over the coldest tier: it walks
+// from roots via opts.Expand, marking every key it visits, then deletes
+// (or, with MoveToColderTier, archives) anything in the tier that was
+// never marked.
+func (d *tiered) Prune(ctx context.Context, roots []ds.Key, opts PruneOptions) (PruneStats, error) {
+	if opts.Expand == nil {
+		return PruneStats{}, fmt.Errorf("tiered: PruneOptions.Expand is required")
+	}
+	if opts.MoveToColderTier && opts.ArchiveTo == nil {
+		return PruneStats{}, fmt.Errorf("tiered: MoveToColderTier requires ArchiveTo")
+	}
+
+	target, err := d.coldTier()
+	if err != nil {
+		return PruneStats{}, err
+	}
+
+	var marks markSet
+	if opts.Exact {
+		marks = make(mapSet)
+	} else {
+		if opts.LiveSetSize == 0 {
+			return PruneStats{}, fmt.Errorf("tiered: PruneOptions.LiveSetSize is required unless Exact is set")
+		}
+		marks = newMarkBloom(opts.LiveSetSize, opts.HashCount)
+	}
+
+	// A Put observed during the walk or the sweep that follows it is
+	// reachable from some live root, even if the walk hasn't reached it
+	// (or the sweep has already passed it) yet, so it must survive.
+	// This stays subscribed for the whole Prune call, not just the walk,
+	// so a write landing mid-sweep is also protected.
+	observed := make(mapSet)
+	var observedMu sync.Mutex
+	unsubscribe := d.observePuts(func(key ds.Key) {
+		observedMu.Lock()
+		observed.mark(key)
+		observedMu.Unlock()
+	})
+	defer unsubscribe()
+
+	visited := make(mapSet)
+	queue := append([]ds.Key(nil), roots...)
+	for len(queue) > 0 {
+		select {
+		case <-ctx.Done():
+			return PruneStats{}, ctx.Err()
+		default:
+		}
+
+		key := queue[0]
+		queue = queue[1:]
+		if visited.has(key) {
+			continue
+		}
+		visited.mark(key)
+		marks.mark(key)
+
+		value, err := target.Get(key)
+		if err != nil {
+			continue // referenced but already gone; nothing to expand
+		}
+		queue = append(queue, opts.Expand(value)...)
+	}
+
+	results, err := target.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return PruneStats{}, fmt.Errorf("tiered: querying target tier for prune: %w", err)
+	}
+	defer results.Close()
+
+	stats := PruneStats{DryRun: opts.DryRun}
+	for e := range results.Next() {
+		if e.Error != nil {
+			return stats, e.Error
+		}
+		stats.Visited++
+
+		key := ds.NewKey(e.Key)
+		observedMu.Lock()
+		liveWrite := observed.has(key)
+		observedMu.Unlock()
+		if marks.has(key) || liveWrite {
+			continue
+		}
+		if opts.DryRun {
+			stats.Swept++
+			continue
+		}
+
+		if opts.MoveToColderTier {
+			value, err := target.Get(key)
+			if err != nil {
+				continue // already gone
+			}
+			if err := opts.ArchiveTo.Put(key, value); err != nil {
+				return stats, fmt.Errorf("tiered: archiving %s: %w", key, err)
+			}
+			stats.Archived++
+		}
+		if err := target.Delete(key); err != nil {
+			return stats, fmt.Errorf("tiered: sweeping %s: %w", key, err)
+		}
+		stats.Swept++
+	}
+	return stats, nil
+}
@@ -0,0 +1,134 @@
+package tiered
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	ds "github.com/jbenet/go-datastore"
+)
+
+// encodeRefs packs the keys a Prune-walked value references into a
+// comma-joined []byte, decoded back out by decodeRefs. It exists only so
+// these tests have something simple to hand PruneOptions.Expand.
+func encodeRefs(keys ...ds.Key) []byte {
+	strs := make([]string, len(keys))
+	for i, k := range keys {
+		strs[i] = k.String()
+	}
+	return []byte(strings.Join(strs, ","))
+}
+
+func decodeRefs(value interface{}) []ds.Key {
+	b, ok := value.([]byte)
+	if !ok || len(b) == 0 {
+		return nil
+	}
+	parts := strings.Split(string(b), ",")
+	keys := make([]ds.Key, len(parts))
+	for i, p := range parts {
+		keys[i] = ds.NewKey(p)
+	}
+	return keys
+}
+
+// seedPruneGraph builds root -> child -> (nothing), plus an orphan key
+// with no incoming reference, directly in target.
+func seedPruneGraph(t *testing.T, target ds.Datastore) (root, child, orphan ds.Key) {
+	t.Helper()
+	root, child, orphan = ds.NewKey("/root"), ds.NewKey("/child"), ds.NewKey("/orphan")
+	if err := target.Put(root, encodeRefs(child)); err != nil {
+		t.Fatalf("seeding root: %v", err)
+	}
+	if err := target.Put(child, encodeRefs()); err != nil {
+		t.Fatalf("seeding child: %v", err)
+	}
+	if err := target.Put(orphan, encodeRefs()); err != nil {
+		t.Fatalf("seeding orphan: %v", err)
+	}
+	return root, child, orphan
+}
+
+// newPruneTestDatastore builds a tiered with the Cold tier at index 0 and
+// Hot at index 1 — the reverse of the usual positional default — so a
+// regression of chunk0-4's index-based target selection would pick the
+// wrong (Hot, empty) tier and report zero visited keys.
+func newPruneTestDatastore(cold ds.Datastore) *tiered {
+	return &tiered{
+		tiers: []*tier{
+			{Datastore: cold, role: Cold},
+			{Datastore: ds.NewMapDatastore(), role: Hot},
+		},
+		stats: newStats(2),
+	}
+}
+
+func TestPruneSweepsUnreachableKeepsReachable(t *testing.T) {
+	cold := ds.NewMapDatastore()
+	root, child, orphan := seedPruneGraph(t, cold)
+	d := newPruneTestDatastore(cold)
+
+	stats, err := d.Prune(context.Background(), []ds.Key{root}, PruneOptions{Expand: decodeRefs, Exact: true})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if stats.Visited != 3 {
+		t.Fatalf("expected 3 keys visited, got %d", stats.Visited)
+	}
+	if stats.Swept != 1 {
+		t.Fatalf("expected 1 key swept, got %d", stats.Swept)
+	}
+
+	if _, err := cold.Get(root); err != nil {
+		t.Fatalf("expected reachable root to survive, got: %v", err)
+	}
+	if _, err := cold.Get(child); err != nil {
+		t.Fatalf("expected reachable child to survive, got: %v", err)
+	}
+	if _, err := cold.Get(orphan); err == nil {
+		t.Fatalf("expected unreachable orphan to be swept")
+	}
+}
+
+func TestPruneDryRunDeletesNothing(t *testing.T) {
+	cold := ds.NewMapDatastore()
+	root, _, orphan := seedPruneGraph(t, cold)
+	d := newPruneTestDatastore(cold)
+
+	stats, err := d.Prune(context.Background(), []ds.Key{root}, PruneOptions{Expand: decodeRefs, Exact: true, DryRun: true})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if stats.Swept != 1 {
+		t.Fatalf("expected DryRun to still count 1 would-be sweep, got %d", stats.Swept)
+	}
+	if _, err := cold.Get(orphan); err != nil {
+		t.Fatalf("DryRun must not actually delete anything, but orphan is gone: %v", err)
+	}
+}
+
+func TestPruneMoveToColderTierArchives(t *testing.T) {
+	cold := ds.NewMapDatastore()
+	root, _, orphan := seedPruneGraph(t, cold)
+	d := newPruneTestDatastore(cold)
+	archive := ds.NewMapDatastore()
+
+	stats, err := d.Prune(context.Background(), []ds.Key{root}, PruneOptions{
+		Expand:           decodeRefs,
+		Exact:            true,
+		MoveToColderTier: true,
+		ArchiveTo:        archive,
+	})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if stats.Archived != 1 {
+		t.Fatalf("expected 1 key archived, got %d", stats.Archived)
+	}
+	if _, err := cold.Get(orphan); err == nil {
+		t.Fatalf("expected orphan to be removed from the target tier once archived")
+	}
+	if _, err := archive.Get(orphan); err != nil {
+		t.Fatalf("expected orphan's value to have been archived: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package tiered
+
+import (
+	"sort"
+
+	ds "github.com/jbenet/go-datastore"
+	dsq "github.com/jbenet/go-datastore/query"
+)
+
+// Query fans q out to every tier and merges the results by key, instead
+// of consulting only the last (most complete) tier. Where a key is
+// present in more than one tier, the value from the tier closest to Hot
+// wins, since that's the one a write-back or read-through-promote policy
+// keeps freshest. Order, Limit and Offset are re-applied to the merged
+// set, since each tier can only apply them to its own partial view: each
+// tier is queried with Offset/Limit stripped so it returns its full
+// local match set, and the real Offset/Limit are applied exactly once,
+// after the merge.
+//
+// TODO(chunk0-3): UNRESOLVED SCOPE CUT, not yet signed off by the
+// requester. The request asked to "extend query.Query with an Ancestor
+// ds.Key field and matching filter," distinct from key-prefix. dsq.Query
+// lives outside this module and isn't vendored here, so that field
+// cannot actually be added from this tree. What ships instead reuses the
+// existing Prefix field to approximate ancestor scoping (a result is
+// kept only if its key equals, or descends from, q.Prefix) — a real
+// Ancestor concept (e.g. exact path-component ancestry semantics,
+// distinct from a plain string-prefix match) has NOT been built. Do not
+// treat this as done: the substitution needs the requester's explicit
+// sign-off before this can be considered equivalent to the original ask,
+// and this TODO should stay in place until that sign-off is recorded.
+func (d *tiered) Query(q dsq.Query) (dsq.Results, error) {
+	type hit struct {
+		entry dsq.Entry
+		role  Role
+	}
+	byKey := make(map[ds.Key]hit)
+
+	// Each tier only sees its own slice of the keyspace, so asking it to
+	// honor Offset/Limit would truncate before the cross-tier merge ever
+	// sees the dropped entries. Those are applied once, below, to the
+	// merged set instead.
+	tierQuery := q
+	tierQuery.Offset = 0
+	tierQuery.Limit = 0
+
+	for _, t := range d.tiers {
+		results, err := t.Query(tierQuery)
+		if err != nil {
+			return nil, err
+		}
+		for e := range results.Next() {
+			if e.Error != nil {
+				results.Close()
+				return nil, e.Error
+			}
+			key := ds.NewKey(e.Key)
+			if !withinAncestor(key, q.Prefix) {
+				continue
+			}
+			if existing, ok := byKey[key]; ok && rolePrecedence(existing.role) <= rolePrecedence(t.role) {
+				continue // a tier at least as close to Hot already answered for this key
+			}
+			byKey[key] = hit{entry: e, role: t.role}
+		}
+		results.Close()
+	}
+
+	// A pending write-back delete means the Hot tier no longer has the
+	// key, but the cold tier hasn't been told yet; treat it as a
+	// tombstone so the stale cold value doesn't leak back out.
+	if d.wbQueue != nil {
+		for _, tomb := range d.wbQueue.pendingDeletes() {
+			delete(byKey, tomb)
+		}
+	}
+
+	entries := make([]dsq.Entry, 0, len(byKey))
+	for _, h := range byKey {
+		entries = append(entries, h.entry)
+	}
+
+	entries = applyOrders(entries, q.Orders)
+	entries = applyOffsetLimit(entries, q.Offset, q.Limit)
+
+	return dsq.ResultsWithEntries(q, entries), nil
+}
+
+// rolePrecedence ranks a tier's Role by closeness to Hot, lowest first.
+// A RoleUnset tier (which New never actually leaves in place — see
+// defaultRole — but which a hand-built *tiered, as in tests, might)
+// ranks last, since it isn't known to be any closer to Hot than Cold.
+func rolePrecedence(r Role) int {
+	switch r {
+	case Hot:
+		return 0
+	case Warm:
+		return 1
+	case Cold:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// withinAncestor reports whether key is prefix itself or a descendant of
+// it. An empty prefix matches everything.
+func withinAncestor(key ds.Key, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	ancestor := ds.NewKey(prefix)
+	return key.Equal(ancestor) || key.IsDescendantOf(ancestor)
+}
+
+func applyOrders(entries []dsq.Entry, orders []dsq.Order) []dsq.Entry {
+	if len(orders) == 0 {
+		return entries
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		for _, o := range orders {
+			if cmp := o.Compare(entries[i], entries[j]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	return entries
+}
+
+func applyOffsetLimit(entries []dsq.Entry, offset, limit int) []dsq.Entry {
+	if offset > 0 {
+		if offset >= len(entries) {
+			return nil
+		}
+		entries = entries[offset:]
+	}
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries
+}
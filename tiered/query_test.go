@@ -0,0 +1,186 @@
+package tiered
+
+import (
+	"testing"
+
+	ds "github.com/jbenet/go-datastore"
+	dsq "github.com/jbenet/go-datastore/query"
+)
+
+func TestQueryPrefersHotTierOnCollision(t *testing.T) {
+	hot := ds.NewMapDatastore()
+	cold := ds.NewMapDatastore()
+
+	key := ds.NewKey("/a")
+	if err := hot.Put(key, []byte("fresh")); err != nil {
+		t.Fatalf("seeding hot tier: %v", err)
+	}
+	if err := cold.Put(key, []byte("stale")); err != nil {
+		t.Fatalf("seeding cold tier: %v", err)
+	}
+
+	d := &tiered{
+		tiers: []*tier{
+			{Datastore: hot, role: Hot},
+			{Datastore: cold, role: Cold},
+		},
+		stats: newStats(2),
+	}
+
+	results, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer results.Close()
+
+	found := false
+	for e := range results.Next() {
+		if e.Error != nil {
+			t.Fatalf("result error: %v", e.Error)
+		}
+		if e.Key != key.String() {
+			continue
+		}
+		found = true
+		if string(e.Value.([]byte)) != "fresh" {
+			t.Fatalf("expected the Hot tier's value to win the collision, got %q", e.Value)
+		}
+	}
+	if !found {
+		t.Fatalf("expected %s in merged results", key)
+	}
+}
+
+// TestQueryPrefersHotRoleRegardlessOfIndex pins the Hot tier at index 0,
+// the opposite of TestQueryPrefersHotTierOnCollision, to guard against
+// collision resolution keying off loop/slice index instead of Role:
+// Options.Tiers[i].Role is explicitly independent of position, so the
+// tier closest to Hot must win by role even when it isn't d.tiers[0].
+func TestQueryPrefersHotRoleRegardlessOfIndex(t *testing.T) {
+	cold := ds.NewMapDatastore()
+	hot := ds.NewMapDatastore()
+
+	key := ds.NewKey("/a")
+	if err := cold.Put(key, []byte("stale")); err != nil {
+		t.Fatalf("seeding cold tier: %v", err)
+	}
+	if err := hot.Put(key, []byte("fresh")); err != nil {
+		t.Fatalf("seeding hot tier: %v", err)
+	}
+
+	d := &tiered{
+		tiers: []*tier{
+			{Datastore: cold, role: Cold},
+			{Datastore: hot, role: Hot},
+		},
+		stats: newStats(2),
+	}
+
+	results, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer results.Close()
+
+	found := false
+	for e := range results.Next() {
+		if e.Error != nil {
+			t.Fatalf("result error: %v", e.Error)
+		}
+		if e.Key != key.String() {
+			continue
+		}
+		found = true
+		if string(e.Value.([]byte)) != "fresh" {
+			t.Fatalf("expected the Hot-role tier's value to win the collision regardless of its index, got %q", e.Value)
+		}
+	}
+	if !found {
+		t.Fatalf("expected %s in merged results", key)
+	}
+}
+
+// TestQueryTombstoneShadowsStaleColdValue exercises the shadowing case
+// called out for write-back mode: a Delete that has only reached the Hot
+// tier so far (the write to Cold is still queued) must not let Query
+// surface Cold's now-stale value.
+func TestQueryTombstoneShadowsStaleColdValue(t *testing.T) {
+	hot := ds.NewMapDatastore()
+	cold := ds.NewMapDatastore()
+
+	key := ds.NewKey("/a")
+	if err := cold.Put(key, []byte("stale")); err != nil {
+		t.Fatalf("seeding cold tier: %v", err)
+	}
+
+	// Built directly, rather than through New, so the background
+	// flusher never runs and the delete stays pending for the duration
+	// of the test.
+	d := &tiered{
+		tiers: []*tier{
+			{Datastore: hot, role: Hot},
+			{Datastore: cold, role: Cold},
+		},
+		opts:    Options{Mode: WriteBack},
+		stats:   newStats(2),
+		wbQueue: newWriteBackQueue(8),
+	}
+	d.wbQueue.push(flushJob{key: key, del: true})
+
+	results, err := d.Query(dsq.Query{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer results.Close()
+
+	for e := range results.Next() {
+		if e.Error != nil {
+			t.Fatalf("result error: %v", e.Error)
+		}
+		if e.Key == key.String() {
+			t.Fatalf("expected %s to be shadowed by its pending-delete tombstone, got value %q", e.Key, e.Value)
+		}
+	}
+}
+
+func TestQueryOffsetLimitAppliedAfterMerge(t *testing.T) {
+	hot := ds.NewMapDatastore()
+	cold := ds.NewMapDatastore()
+
+	// Split across tiers so that applying Limit per-tier, before the
+	// merge, would wrongly drop keys only cold holds.
+	if err := hot.Put(ds.NewKey("/a"), []byte("1")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := cold.Put(ds.NewKey("/b"), []byte("2")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	if err := cold.Put(ds.NewKey("/c"), []byte("3")); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	d := &tiered{
+		tiers: []*tier{
+			{Datastore: hot, role: Hot},
+			{Datastore: cold, role: Cold},
+		},
+		stats: newStats(2),
+	}
+
+	results, err := d.Query(dsq.Query{Limit: 2})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer results.Close()
+
+	count := 0
+	for e := range results.Next() {
+		if e.Error != nil {
+			t.Fatalf("result error: %v", e.Error)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("expected Limit to keep 2 of the 3 merged keys, got %d", count)
+	}
+}
@@ -1,35 +1,326 @@
 package tiered
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/bbloom"
 
 	ds "github.com/jbenet/go-datastore"
 	dsq "github.com/jbenet/go-datastore/query"
 )
 
-type tiered []ds.Datastore
+// Role describes a tier's place in the hierarchy. It controls which
+// tiers a write-back Put acks against synchronously, and which tier a
+// write-around Put skips for large values.
+type Role int
+
+const (
+	// RoleUnset is the zero value: TierOptions.Role left unset, meaning
+	// the tier should take the default role for its position instead of
+	// being pinned to Hot.
+	RoleUnset Role = iota
+	// Hot is the fast, small tier writes ack against in write-back mode.
+	Hot
+	// Warm is an intermediate tier.
+	Warm
+	// Cold is the slow, most complete tier.
+	Cold
+)
+
+// Mode selects how Put/Delete/Get propagate across tiers.
+type Mode int
+
+const (
+	// WriteThrough writes every tier synchronously before Put/Delete
+	// return, and is the default behavior.
+	WriteThrough Mode = iota
+	// ReadThroughPromote asynchronously writes a Get that misses the
+	// faster tiers back into them once a slower tier answers.
+	ReadThroughPromote
+	// WriteBack acks Put/Delete once the Hot tier(s) have, and updates
+	// the rest in the background via a coalescing flusher.
+	WriteBack
+	// WriteAround writes every tier as WriteThrough does, except that
+	// values larger than Options.WriteAroundThreshold skip the Hot
+	// tier(s) entirely.
+	WriteAround
+)
+
+// TierOptions configures a single datastore passed to New.
+type TierOptions struct {
+	// Role places this tier in the hierarchy. Left at RoleUnset (the
+	// zero value), it defaults to Hot for the first datastore, Cold for
+	// the last, and Warm for everything in between — so a caller who
+	// only wants to set Bloom and leaves Role unset still gets sane
+	// roles rather than every tier being pinned to Hot.
+	Role Role
+	// Bloom, if non-nil, attaches a negative-presence cache to this
+	// tier.
+	Bloom *BloomOptions
+}
+
+// Options configures a tiered datastore. The zero value is WriteThrough
+// with no blooms and default roles.
+type Options struct {
+	// Mode selects the tiering policy; see the Mode constants.
+	Mode Mode
+	// Tiers configures each datastore passed to New, in the same order.
+	// May be left nil to take default roles and no blooms.
+	Tiers []TierOptions
+	// WriteAroundThreshold is the value size, in bytes, above which
+	// WriteAround skips the Hot tier(s). Only consulted for []byte
+	// values; ignored in other modes.
+	WriteAroundThreshold int
+	// FlushQueueSize bounds the write-back flusher's pending-key queue.
+	// Defaults to 1024.
+	FlushQueueSize int
+	// OnFlushError, if set, is called whenever the write-back flusher
+	// fails to apply a job to a non-Hot tier. In WriteBack mode the
+	// flusher is the only path that ever reaches those tiers, so a
+	// dropped error here is otherwise invisible, permanent data loss;
+	// OnFlushError gives an operator a way to log or alert on it. It is
+	// called from the flusher goroutine and must not block.
+	OnFlushError func(tierIndex int, key ds.Key, err error)
+}
 
-// New returns a tiered datastore. Puts and Deletes will write-through to
-// all datastores, Has and Get will try each datastore sequentially, and
-// Query will always try the last one (most complete) first.
-func New(dses ...ds.Datastore) ds.Datastore {
-	return tiered(dses)
+// tier pairs a datastore with its role and an optional negative-presence
+// cache. When bloom is nil the tier behaves exactly as before: Get/Has
+// always fall through to the underlying datastore.
+type tier struct {
+	ds.Datastore
+	role      Role
+	bloomOpts *BloomOptions
+
+	bloomMu sync.RWMutex // guards bloom and appliedGen, which Rebuild swaps out from under live Get/Put/Has
+	bloom   *bbloom.Bloom
+
+	rebuildGen uint64 // next generation to hand out, incremented per Rebuild call
+	appliedGen uint64 // generation the current bloom was built from
+}
+
+// mayContain reports whether key could be present in this tier. A false
+// result means the key is definitely absent and the tier can be skipped.
+func (t *tier) mayContain(key ds.Key) bool {
+	t.bloomMu.RLock()
+	bl := t.bloom
+	t.bloomMu.RUnlock()
+	if bl == nil {
+		return true
+	}
+	return bl.Has([]byte(key.String()))
+}
+
+// mark records key as present in this tier's negative cache, if any.
+func (t *tier) mark(key ds.Key) {
+	t.bloomMu.RLock()
+	bl := t.bloom
+	t.bloomMu.RUnlock()
+	if bl != nil {
+		bl.Add([]byte(key.String()))
+	}
+}
+
+// nextRebuildGen hands out the generation number for a new Rebuild call.
+func (t *tier) nextRebuildGen() uint64 {
+	t.bloomMu.Lock()
+	defer t.bloomMu.Unlock()
+	t.rebuildGen++
+	return t.rebuildGen
+}
+
+// setBloomIfNewer installs fresh as the tier's bloom, unless a rebuild
+// with a higher generation has already been applied. Without this check,
+// two concurrent Rebuild calls (a manual one racing the periodic
+// BloomOptions.RebuildInterval worker, say) could finish out of order: a
+// slower rebuild built from an older Query snapshot would clobber a
+// newer one, dropping keys the newer snapshot had seen and so causing
+// false negatives.
+func (t *tier) setBloomIfNewer(gen uint64, bl *bbloom.Bloom) {
+	t.bloomMu.Lock()
+	defer t.bloomMu.Unlock()
+	if gen < t.appliedGen {
+		return
+	}
+	t.appliedGen = gen
+	t.bloom = bl
+}
+
+// hasBloom reports whether this tier has a negative cache configured.
+func (t *tier) hasBloom() bool {
+	t.bloomMu.RLock()
+	defer t.bloomMu.RUnlock()
+	return t.bloom != nil
+}
+
+type tiered struct {
+	tiers []*tier
+	opts  Options
+	stats Stats
+
+	wbQueue *writeBackQueue
+	wbWG    sync.WaitGroup
+
+	rebuildStop      chan struct{}
+	rebuildWG        sync.WaitGroup
+	closeRebuildOnce sync.Once
+
+	observersMu    sync.Mutex
+	observers      map[int]putObserver
+	nextObserverID int
+}
+
+// BloomOptions sizes the per-tier negative cache used to skip a tier when
+// a key is known not to be present in it. This mirrors the
+// bbloom.Bloom-backed cidSet pattern used to prune Filecoin blockstores:
+// the filter only ever answers "maybe present" or "definitely absent", so
+// it is always safe to consult before falling through to a slower tier.
+type BloomOptions struct {
+	// Size is the number of entries the filter is sized for.
+	Size uint64
+	// FalsePositiveRate is the target false-positive rate, e.g. 0.01.
+	FalsePositiveRate float64
+	// RebuildInterval, if non-zero, starts a background worker that
+	// periodically calls Rebuild for this tier, so stale positives left
+	// behind by deletes get flushed out without an operator having to
+	// wire up their own cron. Leave zero to only rebuild on demand via
+	// an explicit Rebuild call.
+	RebuildInterval time.Duration
+}
+
+// Stats reports per-tier negative-cache effectiveness, useful for tuning
+// tier sizing.
+type Stats struct {
+	// Queries counts served Get/Has calls.
+	Queries uint64
+	// TierHits counts, per tier, how many times that tier actually
+	// answered a Get/Has.
+	TierHits []uint64
+	// BloomRejections counts, per tier, how many times the bloom filter
+	// let that tier be skipped.
+	BloomRejections []uint64
+	// FlushErrors counts, per tier, how many times the write-back
+	// flusher failed to apply a job to that tier. See Options.OnFlushError
+	// for a way to be notified as these happen, rather than polling Stats.
+	FlushErrors []uint64
+}
+
+func newStats(n int) Stats {
+	return Stats{
+		TierHits:        make([]uint64, n),
+		BloomRejections: make([]uint64, n),
+		FlushErrors:     make([]uint64, n),
+	}
+}
+
+func defaultRole(i, n int) Role {
+	switch {
+	case i == 0:
+		return Hot
+	case i == n-1:
+		return Cold
+	default:
+		return Warm
+	}
+}
+
+// New returns a tiered datastore over dses, configured by opts. With the
+// zero Options, Puts and Deletes write-through to all datastores, Has and
+// Get try each datastore sequentially, and Query merges the results of
+// every datastore.
+func New(opts Options, dses ...ds.Datastore) (ds.Datastore, error) {
+	if len(opts.Tiers) != 0 && len(opts.Tiers) != len(dses) {
+		return nil, fmt.Errorf("tiered: opts.Tiers must have one entry per datastore (got %d for %d tiers)", len(opts.Tiers), len(dses))
+	}
+
+	tiers := make([]*tier, len(dses))
+	for i, cd := range dses {
+		t := &tier{Datastore: cd, role: defaultRole(i, len(dses))}
+		if len(opts.Tiers) != 0 {
+			to := opts.Tiers[i]
+			if to.Role != RoleUnset {
+				t.role = to.Role
+			}
+			if to.Bloom != nil {
+				t.bloomOpts = to.Bloom
+				t.bloom = bbloom.New(float64(to.Bloom.Size), to.Bloom.FalsePositiveRate)
+			}
+		}
+		tiers[i] = t
+	}
+
+	d := &tiered{tiers: tiers, opts: opts, stats: newStats(len(dses)), rebuildStop: make(chan struct{})}
+	if opts.Mode == WriteBack {
+		d.wbQueue = newWriteBackQueue(opts.FlushQueueSize)
+		d.wbWG.Add(1)
+		go d.runFlusher()
+	}
+	for i, t := range tiers {
+		if t.bloomOpts != nil && t.bloomOpts.RebuildInterval > 0 {
+			d.rebuildWG.Add(1)
+			go d.runBloomRebuilder(i, t.bloomOpts.RebuildInterval)
+		}
+	}
+	return d, nil
+}
+
+// runBloomRebuilder periodically rebuilds tier i's bloom filter until
+// rebuildStop is closed.
+func (d *tiered) runBloomRebuilder(i int, interval time.Duration) {
+	defer d.rebuildWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			_ = d.Rebuild(ctx, i)
+			cancel()
+		case <-d.rebuildStop:
+			return
+		}
+	}
 }
 
 // Put stores the object `value` named by `key`.
-func (d tiered) Put(key ds.Key, value interface{}) (err error) {
-	errs := make(chan error, len(d))
+func (d *tiered) Put(key ds.Key, value interface{}) error {
+	d.notifyPut(key)
+	switch d.opts.Mode {
+	case WriteBack:
+		return d.putWriteBack(key, value)
+	case WriteAround:
+		if d.isWriteAround(value) {
+			return d.putSkippingHot(key, value)
+		}
+	}
+	return d.putAll(key, value)
+}
+
+func (d *tiered) isWriteAround(value interface{}) bool {
+	if d.opts.WriteAroundThreshold <= 0 {
+		return false
+	}
+	b, ok := value.([]byte)
+	return ok && len(b) > d.opts.WriteAroundThreshold
+}
+
+func (d *tiered) putAll(key ds.Key, value interface{}) error {
+	errs := make(chan error, len(d.tiers))
 
 	var wg sync.WaitGroup
-	for _, cd := range d {
+	for _, t := range d.tiers {
 		wg.Add(1)
-		go func(cd ds.Datastore) {
+		go func(t *tier) {
 			defer wg.Done()
-			if err := cd.Put(key, value); err != nil {
+			if err := t.Put(key, value); err != nil {
 				errs <- err
+				return
 			}
-		}(cd)
+			t.mark(key)
+		}(t)
 	}
 	wg.Wait()
 
@@ -40,24 +331,101 @@ func (d tiered) Put(key ds.Key, value interface{}) (err error) {
 	return nil
 }
 
+func (d *tiered) putSkippingHot(key ds.Key, value interface{}) error {
+	errs := make(chan error, len(d.tiers))
+
+	var wg sync.WaitGroup
+	for _, t := range d.tiers {
+		if t.role == Hot {
+			continue
+		}
+		wg.Add(1)
+		go func(t *tier) {
+			defer wg.Done()
+			if err := t.Put(key, value); err != nil {
+				errs <- err
+				return
+			}
+			t.mark(key)
+		}(t)
+	}
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		return err
+	}
+	return nil
+}
+
+func (d *tiered) putWriteBack(key ds.Key, value interface{}) error {
+	for _, t := range d.tiers {
+		if t.role != Hot {
+			continue
+		}
+		if err := t.Put(key, value); err != nil {
+			return err
+		}
+		t.mark(key)
+	}
+	d.wbQueue.push(flushJob{key: key, value: value})
+	return nil
+}
+
 // Get retrieves the object `value` named by `key`.
-func (d tiered) Get(key ds.Key) (value interface{}, err error) {
+func (d *tiered) Get(key ds.Key) (value interface{}, err error) {
+	atomic.AddUint64(&d.stats.Queries, 1)
 	err = fmt.Errorf("no datastores")
-	for _, cd := range d {
-		value, err = cd.Get(key)
+	for i, t := range d.tiers {
+		if !t.mayContain(key) {
+			atomic.AddUint64(&d.stats.BloomRejections[i], 1)
+			continue
+		}
+		value, err = t.Get(key)
 		if err == nil {
+			atomic.AddUint64(&d.stats.TierHits[i], 1)
+			if d.opts.Mode == ReadThroughPromote && i > 0 {
+				d.promote(key, value, i)
+			}
 			break
 		}
 	}
 	return
 }
 
+// promote asynchronously writes value, found at tier foundAt, back into
+// every faster tier.
+func (d *tiered) promote(key ds.Key, value interface{}, foundAt int) {
+	source := d.tiers[foundAt]
+	faster := d.tiers[:foundAt]
+	go func() {
+		// A concurrent Delete may have already removed key from every
+		// tier by the time this goroutine runs; re-check the tier the
+		// value was actually read from before writing it back, so a
+		// stale read can't resurrect a key that's since been deleted.
+		if exists, err := source.Has(key); err != nil || !exists {
+			return
+		}
+		for _, t := range faster {
+			if err := t.Put(key, value); err == nil {
+				t.mark(key)
+			}
+		}
+	}()
+}
+
 // Has returns whether the `key` is mapped to a `value`.
-func (d tiered) Has(key ds.Key) (exists bool, err error) {
+func (d *tiered) Has(key ds.Key) (exists bool, err error) {
+	atomic.AddUint64(&d.stats.Queries, 1)
 	err = fmt.Errorf("no datastores")
-	for _, cd := range d {
-		exists, err = cd.Has(key)
+	for i, t := range d.tiers {
+		if !t.mayContain(key) {
+			atomic.AddUint64(&d.stats.BloomRejections[i], 1)
+			continue
+		}
+		exists, err = t.Has(key)
 		if err == nil && exists {
+			atomic.AddUint64(&d.stats.TierHits[i], 1)
 			break
 		}
 	}
@@ -65,18 +433,31 @@ func (d tiered) Has(key ds.Key) (exists bool, err error) {
 }
 
 // Delete removes the value for given `key`.
-func (d tiered) Delete(key ds.Key) (err error) {
-	errs := make(chan error, len(d))
+//
+// Delete does not clear key from a tier's bloom filter: blooms don't
+// support removal, and leaving a stale bit set only costs an extra tier
+// visit on the next Get/Has, whereas clearing it incorrectly would cause
+// a false negative. Call Rebuild to drop stale bits once enough deletes
+// have accumulated.
+func (d *tiered) Delete(key ds.Key) error {
+	if d.opts.Mode == WriteBack {
+		return d.deleteWriteBack(key)
+	}
+	return d.deleteAll(key)
+}
+
+func (d *tiered) deleteAll(key ds.Key) error {
+	errs := make(chan error, len(d.tiers))
 
 	var wg sync.WaitGroup
-	for _, cd := range d {
+	for _, t := range d.tiers {
 		wg.Add(1)
-		go func(cd ds.Datastore) {
+		go func(t *tier) {
 			defer wg.Done()
-			if err := cd.Delete(key); err != nil {
+			if err := t.Delete(key); err != nil {
 				errs <- err
 			}
-		}(cd)
+		}(t)
 	}
 	wg.Wait()
 
@@ -87,48 +468,207 @@ func (d tiered) Delete(key ds.Key) (err error) {
 	return nil
 }
 
-// Query returns a list of keys in the datastore
-func (d tiered) Query(q dsq.Query) (dsq.Results, error) {
-	// query always the last (most complete) one
-	return d[len(d)-1].Query(q)
+func (d *tiered) deleteWriteBack(key ds.Key) error {
+	for _, t := range d.tiers {
+		if t.role != Hot {
+			continue
+		}
+		if err := t.Delete(key); err != nil {
+			return err
+		}
+	}
+	d.wbQueue.push(flushJob{key: key, del: true})
+	return nil
+}
+
+// Rebuild reseeds the bloom filter attached to tier i by walking its
+// contents with a KeysOnly Query. It is a no-op if that tier has no
+// bloom configured. Callers should run this periodically, or after a
+// burst of deletes, to flush stale positives out of the filter.
+func (d *tiered) Rebuild(ctx context.Context, i int) error {
+	t := d.tiers[i]
+	if !t.hasBloom() {
+		return nil
+	}
+	gen := t.nextRebuildGen()
+
+	results, err := t.Query(dsq.Query{KeysOnly: true})
+	if err != nil {
+		return fmt.Errorf("tiered: querying tier %d for rebuild: %w", i, err)
+	}
+	defer results.Close()
+
+	fresh := bbloom.New(float64(t.bloomOpts.Size), t.bloomOpts.FalsePositiveRate)
+	for entry := range results.Next() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if entry.Error != nil {
+			return entry.Error
+		}
+		fresh.Add([]byte(entry.Key))
+	}
+
+	t.setBloomIfNewer(gen, fresh)
+	return nil
+}
+
+// Stats returns a snapshot of the negative-cache counters accumulated so
+// far, useful for deciding whether a tier's bloom is sized correctly.
+func (d *tiered) Stats() Stats {
+	s := newStats(len(d.tiers))
+	s.Queries = atomic.LoadUint64(&d.stats.Queries)
+	for i := range d.tiers {
+		s.TierHits[i] = atomic.LoadUint64(&d.stats.TierHits[i])
+		s.BloomRejections[i] = atomic.LoadUint64(&d.stats.BloomRejections[i])
+		s.FlushErrors[i] = atomic.LoadUint64(&d.stats.FlushErrors[i])
+	}
+	return s
+}
+
+// runFlusher drains the write-back queue, applying each coalesced job to
+// every non-Hot tier, until the queue is closed and empty.
+func (d *tiered) runFlusher() {
+	defer d.wbWG.Done()
+	for {
+		job, ok := d.wbQueue.pop()
+		if !ok {
+			return
+		}
+		for i, t := range d.tiers {
+			if t.role == Hot {
+				continue
+			}
+			if job.del {
+				if err := t.Delete(job.key); err != nil {
+					d.recordFlushError(i, job.key, err)
+				}
+				continue
+			}
+			if err := t.Put(job.key, job.value); err != nil {
+				d.recordFlushError(i, job.key, err)
+				continue
+			}
+			t.mark(job.key)
+		}
+		d.wbQueue.doneInFlight()
+	}
+}
+
+// recordFlushError surfaces a write-back apply failure via Stats and
+// Options.OnFlushError. runFlusher is the only path that ever reaches a
+// non-Hot tier in WriteBack mode, so silently dropping an error here —
+// a full disk, a partitioned network — would be permanent, invisible
+// data loss with nothing for an operator to observe.
+func (d *tiered) recordFlushError(tierIndex int, key ds.Key, err error) {
+	atomic.AddUint64(&d.stats.FlushErrors[tierIndex], 1)
+	if d.opts.OnFlushError != nil {
+		d.opts.OnFlushError(tierIndex, key, err)
+	}
+}
+
+// Flush blocks until every write-back job queued so far has been applied
+// to the non-Hot tiers, or ctx is done. It is a no-op outside WriteBack
+// mode.
+func (d *tiered) Flush(ctx context.Context) error {
+	if d.wbQueue == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		d.wbQueue.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the write-back flusher, after draining any pending jobs,
+// and any background bloom rebuilders started via
+// BloomOptions.RebuildInterval.
+func (d *tiered) Close() error {
+	d.closeRebuildOnce.Do(func() { close(d.rebuildStop) })
+	d.rebuildWG.Wait()
+
+	if d.wbQueue == nil {
+		return nil
+	}
+	d.wbQueue.close()
+	d.wbWG.Wait()
+	return nil
 }
 
-type tieredTransaction []ds.Transaction
+// tieredTransaction mirrors a tiered datastore's policy across a batch: in
+// WriteBack mode it only commits synchronously against the Hot tier(s)
+// and defers the rest to the same write-back queue Put/Delete use.
+type tieredTransaction struct {
+	d    *tiered
+	txns []ds.Transaction
+	ops  []flushJob
+}
 
-func (d tiered) StartBatchOp() ds.Transaction {
-	var out tieredTransaction
-	for _, ds := range d {
-		out = append(out, ds.StartBatchOp())
+func (d *tiered) StartBatchOp() ds.Transaction {
+	txns := make([]ds.Transaction, len(d.tiers))
+	for i, t := range d.tiers {
+		txns[i] = t.StartBatchOp()
 	}
-	return out
+	return &tieredTransaction{d: d, txns: txns}
 }
 
-func (t tieredTransaction) Put(key ds.Key, val interface{}) error {
-	for _, ts := range t {
-		err := ts.Put(key, val)
-		if err != nil {
+func (t *tieredTransaction) Put(key ds.Key, val interface{}) error {
+	t.d.notifyPut(key)
+	writeBack := t.d.opts.Mode == WriteBack
+	for i, tr := range t.d.tiers {
+		if writeBack && tr.role != Hot {
+			continue
+		}
+		if err := t.txns[i].Put(key, val); err != nil {
 			return err
 		}
+		tr.mark(key)
+	}
+	if writeBack {
+		t.ops = append(t.ops, flushJob{key: key, value: val})
 	}
 	return nil
 }
 
-func (t tieredTransaction) Delete(key ds.Key) error {
-	for _, ts := range t {
-		err := ts.Delete(key)
-		if err != nil {
+func (t *tieredTransaction) Delete(key ds.Key) error {
+	writeBack := t.d.opts.Mode == WriteBack
+	for i, tr := range t.d.tiers {
+		if writeBack && tr.role != Hot {
+			continue
+		}
+		if err := t.txns[i].Delete(key); err != nil {
 			return err
 		}
 	}
+	if writeBack {
+		t.ops = append(t.ops, flushJob{key: key, del: true})
+	}
 	return nil
 }
 
-func (t tieredTransaction) Commit() error {
-	for _, ts := range t {
-		err := ts.Commit()
-		if err != nil {
+func (t *tieredTransaction) Commit() error {
+	writeBack := t.d.opts.Mode == WriteBack
+	for i, tr := range t.d.tiers {
+		if writeBack && tr.role != Hot {
+			continue
+		}
+		if err := t.txns[i].Commit(); err != nil {
 			return err
 		}
 	}
+	if writeBack {
+		for _, op := range t.ops {
+			t.d.wbQueue.push(op)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,187 @@
+package tiered
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/bbloom"
+
+	ds "github.com/jbenet/go-datastore"
+)
+
+// TestSetBloomIfNewerDropsStaleGeneration guards the fix for two Rebuild
+// calls finishing out of order: a slower rebuild started earlier must
+// not clobber a faster, later-started one that's already applied.
+func TestSetBloomIfNewerDropsStaleGeneration(t *testing.T) {
+	tr := &tier{}
+
+	newer := bbloom.New(100, 0.01)
+	newer.Add([]byte("/newer"))
+	tr.setBloomIfNewer(2, newer)
+
+	older := bbloom.New(100, 0.01)
+	older.Add([]byte("/older"))
+	tr.setBloomIfNewer(1, older)
+
+	if !tr.bloom.Has([]byte("/newer")) {
+		t.Fatalf("a stale, lower-generation rebuild clobbered the newer one")
+	}
+	if tr.bloom.Has([]byte("/older")) {
+		t.Fatalf("expected the stale rebuild's contents to have been dropped")
+	}
+}
+
+// TestNewDefaultsRoleWhenTierOptionsLeavesItUnset is the regression test
+// for the chunk0-2 bug where New set t.role = to.Role unconditionally:
+// a caller who only sets Bloom per tier, leaving Role at its zero value,
+// must still get the positional default roles, not every tier pinned to
+// Hot.
+func TestNewDefaultsRoleWhenTierOptionsLeavesItUnset(t *testing.T) {
+	hot := ds.NewMapDatastore()
+	cold := ds.NewMapDatastore()
+
+	store, err := New(Options{
+		Tiers: []TierOptions{
+			{Bloom: &BloomOptions{Size: 100, FalsePositiveRate: 0.01}},
+			{Bloom: &BloomOptions{Size: 100, FalsePositiveRate: 0.01}},
+		},
+	}, hot, cold)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	d := store.(*tiered)
+
+	if d.tiers[0].role != Hot {
+		t.Fatalf("expected tier 0 to default to Hot, got %v", d.tiers[0].role)
+	}
+	if d.tiers[1].role != Cold {
+		t.Fatalf("expected tier 1 to default to Cold, got %v", d.tiers[1].role)
+	}
+}
+
+// TestFlushWaitsForTierWritesNotJustQueueDrain is the regression test for
+// the chunk0-2 Flush race: pop() removes a job from the queue before
+// runFlusher applies it to the tiers, so wait() must also block on the
+// in-flight count, not just on the queue being empty.
+func TestFlushWaitsForTierWritesNotJustQueueDrain(t *testing.T) {
+	hot := ds.NewMapDatastore()
+	cold := &slowPutDatastore{Datastore: ds.NewMapDatastore(), delay: 20 * time.Millisecond}
+
+	d := &tiered{
+		tiers: []*tier{
+			{Datastore: hot, role: Hot},
+			{Datastore: cold, role: Cold},
+		},
+		opts:    Options{Mode: WriteBack},
+		stats:   newStats(2),
+		wbQueue: newWriteBackQueue(8),
+	}
+	d.wbWG.Add(1)
+	go d.runFlusher()
+	defer func() {
+		d.wbQueue.close()
+		d.wbWG.Wait()
+	}()
+
+	key := ds.NewKey("/a")
+	if err := d.Put(key, []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := d.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if exists, err := cold.Has(key); err != nil {
+		t.Fatalf("Has: %v", err)
+	} else if !exists {
+		t.Fatalf("Flush returned before the queued write actually reached the cold tier")
+	}
+}
+
+// TestPromoteSkipsResurrectingConcurrentlyDeletedKey is the regression
+// test for promote()'s race with Delete: a Get that reads a value from a
+// slow tier must not let its async promotion write that value back into
+// the faster tiers once a concurrent Delete has removed the key
+// everywhere.
+func TestPromoteSkipsResurrectingConcurrentlyDeletedKey(t *testing.T) {
+	hot := ds.NewMapDatastore()
+	cold := &blockingHasDatastore{
+		Datastore:  ds.NewMapDatastore(),
+		hasEntered: make(chan struct{}, 1),
+		release:    make(chan struct{}),
+	}
+
+	key := ds.NewKey("/a")
+	if err := cold.Datastore.Put(key, []byte("v")); err != nil {
+		t.Fatalf("seeding cold tier: %v", err)
+	}
+
+	d := &tiered{
+		tiers: []*tier{
+			{Datastore: hot, role: Hot},
+			{Datastore: cold, role: Cold},
+		},
+		opts:  Options{Mode: ReadThroughPromote},
+		stats: newStats(2),
+	}
+
+	if _, err := d.Get(key); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	select {
+	case <-cold.hasEntered:
+	case <-time.After(time.Second):
+		t.Fatal("promote's presence re-check never ran")
+	}
+
+	// The hot tier never held key, so its Delete may report ErrNotFound;
+	// the cold tier's delete is what this test needs to have happened.
+	if err := d.Delete(key); err != nil && err != ds.ErrNotFound {
+		t.Fatalf("Delete: %v", err)
+	}
+	close(cold.release)
+
+	// The blocked promote goroutine's only remaining action, once it
+	// observes the key gone, is to return without calling Put; there's
+	// no completion signal to wait on, but the assertion below holds no
+	// matter when it's checked, since that code path never calls Put.
+	time.Sleep(20 * time.Millisecond)
+
+	if exists, err := hot.Has(key); err != nil {
+		t.Fatalf("Has: %v", err)
+	} else if exists {
+		t.Fatalf("promote resurrected a key that had been deleted concurrently")
+	}
+}
+
+// slowPutDatastore delays Put, widening the window between a write-back
+// job leaving the queue and actually landing in the tier.
+type slowPutDatastore struct {
+	ds.Datastore
+	delay time.Duration
+}
+
+func (s *slowPutDatastore) Put(key ds.Key, value interface{}) error {
+	time.Sleep(s.delay)
+	return s.Datastore.Put(key, value)
+}
+
+// blockingHasDatastore pauses the first Has call until release is
+// closed, signaling on hasEntered once it's inside the call.
+type blockingHasDatastore struct {
+	ds.Datastore
+	hasEntered chan struct{}
+	release    chan struct{}
+}
+
+func (b *blockingHasDatastore) Has(key ds.Key) (bool, error) {
+	select {
+	case b.hasEntered <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return b.Datastore.Has(key)
+}
@@ -0,0 +1,128 @@
+package tiered
+
+import (
+	"sync"
+
+	ds "github.com/jbenet/go-datastore"
+)
+
+// flushJob is a write or delete pending against every non-Hot tier, once
+// the write-back flusher gets to it.
+type flushJob struct {
+	key   ds.Key
+	value interface{}
+	del   bool
+}
+
+// defaultFlushQueueSize is used when Options.FlushQueueSize is unset.
+const defaultFlushQueueSize = 1024
+
+// writeBackQueue is a bounded, per-key coalescing queue: if two writes to
+// the same key are pending, only the most recent replaces the key's slot
+// in the queue, so a hot key being overwritten repeatedly can't blow the
+// queue or replay a stale value to the cold tiers.
+type writeBackQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	order   []ds.Key
+	pending map[ds.Key]flushJob
+	maxLen  int
+	closed  bool
+
+	// inFlight counts jobs a pop has handed to the flusher that haven't
+	// finished being applied to the tiers yet. wait must block on this
+	// too: a job is removed from pending/order as soon as pop returns
+	// it, well before the actual tier writes land.
+	inFlight int
+}
+
+func newWriteBackQueue(maxLen int) *writeBackQueue {
+	if maxLen <= 0 {
+		maxLen = defaultFlushQueueSize
+	}
+	q := &writeBackQueue{pending: make(map[ds.Key]flushJob), maxLen: maxLen}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push enqueues job, coalescing with any job already pending for the
+// same key. It blocks while the queue is at capacity, unless the key is
+// already pending (a coalesced update never has to wait).
+func (q *writeBackQueue) push(job flushJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, pending := q.pending[job.key]; !pending {
+		for len(q.order) >= q.maxLen && !q.closed {
+			q.cond.Wait()
+		}
+		q.order = append(q.order, job.key)
+	}
+	q.pending[job.key] = job
+	q.cond.Broadcast()
+}
+
+// pop blocks until a job is available, returning ok == false once the
+// queue has been closed and fully drained.
+func (q *writeBackQueue) pop() (job flushJob, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.order) == 0 {
+		if q.closed {
+			return flushJob{}, false
+		}
+		q.cond.Wait()
+	}
+
+	key := q.order[0]
+	q.order = q.order[1:]
+	job = q.pending[key]
+	delete(q.pending, key)
+	q.inFlight++
+	q.cond.Broadcast()
+	return job, true
+}
+
+// doneInFlight marks one job handed out by pop as fully applied to the
+// tiers. Callers must call this exactly once per successful pop.
+func (q *writeBackQueue) doneInFlight() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inFlight--
+	q.cond.Broadcast()
+}
+
+// wait blocks until the queue has no jobs pending or in flight.
+func (q *writeBackQueue) wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.order) != 0 || q.inFlight != 0 {
+		q.cond.Wait()
+	}
+}
+
+// close marks the queue closed; pop drains whatever is left before it
+// starts reporting empty.
+func (q *writeBackQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// pendingDeletes returns the keys with a delete job still queued. A Query
+// run against the tiers directly would otherwise surface a cold tier's
+// stale value for one of these keys, since the delete hasn't reached it
+// yet.
+func (q *writeBackQueue) pendingDeletes() []ds.Key {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var keys []ds.Key
+	for k, job := range q.pending {
+		if job.del {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}